@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"gortc.io/stun"
+)
+
+// Authenticator resolves the long-term credential key for a username/realm
+// pair, mirroring the pluggable GetCode/Authenticate split used by socks5
+// authenticators but adapted to STUN's key material: MD5(username ":"
+// realm ":" password), ready to use as a stun.MessageIntegrity key.
+type Authenticator interface {
+	// Lookup returns the long-term key for username in realm, and whether
+	// the user is known. Implementations must not block for long, as it is
+	// called from the request-handling path.
+	Lookup(username, realm string) (key []byte, ok bool)
+}
+
+// staticAuthenticator authenticates against a fixed username/password
+// table, typically loaded once from Config.Users.
+type staticAuthenticator struct {
+	realm string
+	users map[string]string
+}
+
+// newStaticAuthenticator builds an Authenticator backed by an in-memory
+// user table for a single realm.
+func newStaticAuthenticator(realm string, users map[string]string) *staticAuthenticator {
+	return &staticAuthenticator{realm: realm, users: users}
+}
+
+func (a *staticAuthenticator) Lookup(username, realm string) (key []byte, ok bool) {
+	if realm != a.realm {
+		return nil, false
+	}
+	password, ok := a.users[username]
+	if !ok {
+		return nil, false
+	}
+	return longTermKey(username, realm, password), true
+}
+
+// longTermKey computes the RFC 5389 long-term credential key
+// MD5(username ":" realm ":" password).
+func longTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+// nonceStore is an in-memory cache of server-generated nonces, each valid
+// for ttl after issue. Expired nonces are rotated out lazily on access.
+type nonceStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+// newNonceStore creates a nonceStore whose entries expire after ttl.
+func newNonceStore(ttl time.Duration) *nonceStore {
+	return &nonceStore{
+		ttl:     ttl,
+		expires: make(map[string]time.Time),
+	}
+}
+
+// New issues a fresh nonce and remembers it until it expires.
+func (s *nonceStore) New() string {
+	n := randomNonce()
+	s.mu.Lock()
+	s.gc()
+	s.expires[n] = time.Now().Add(s.ttl)
+	s.mu.Unlock()
+	return n
+}
+
+// Valid reports whether n was issued by this store and has not expired.
+func (s *nonceStore) Valid(n string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exp, ok := s.expires[n]
+	if !ok || time.Now().After(exp) {
+		delete(s.expires, n)
+		return false
+	}
+	return true
+}
+
+// gc drops expired nonces. Callers must hold s.mu.
+func (s *nonceStore) gc() {
+	now := time.Now()
+	for n, exp := range s.expires {
+		if now.After(exp) {
+			delete(s.expires, n)
+		}
+	}
+}
+
+func randomNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// authenticate verifies USERNAME/REALM/NONCE/MESSAGE-INTEGRITY on req
+// against s.Auth and s.Nonces. It returns the long-term key on success so
+// the caller can sign the response with the same key.
+func (s *Server) authenticate(req *stun.Message) (key []byte, ok bool) {
+	var (
+		username stun.Username
+		realm    stun.Realm
+		nonce    stun.Nonce
+	)
+	if username.GetFrom(req) != nil {
+		return nil, false
+	}
+	if realm.GetFrom(req) != nil {
+		return nil, false
+	}
+	if nonce.GetFrom(req) != nil {
+		return nil, false
+	}
+	if !s.Nonces.Valid(string(nonce)) {
+		return nil, false
+	}
+	key, ok = s.Auth.Lookup(string(username), string(realm))
+	if !ok {
+		return nil, false
+	}
+	integrity := stun.MessageIntegrity(key)
+	if integrity.Check(req) != nil {
+		return nil, false
+	}
+	return key, true
+}
+
+// challenge replies 401 (Unauthorized) with a fresh REALM/NONCE pair, per
+// RFC 5389 Section 10.2, prompting the client to retry with credentials.
+func (s *Server) challenge(req, res *stun.Message) error {
+	return res.Build(req,
+		stun.BindingError,
+		software,
+		&stun.ErrorCodeAttribute{Code: stun.CodeUnauthorized},
+		stun.NewRealm(s.Realm),
+		stun.NewNonce(s.Nonces.New()),
+		stun.Fingerprint,
+	)
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// tryBatchServe serves c via recvmmsg/sendmmsg batching when s.BatchSize
+// is set and c is a UDP socket, amortizing syscall overhead on a busy
+// endpoint. Returns handled=false if batching doesn't apply, so the
+// caller falls back to Serve.
+func (s *Server) tryBatchServe(c net.PacketConn) (handled bool, err error) {
+	udpConn, ok := c.(*net.UDPConn)
+	if !ok || s.BatchSize <= 0 {
+		return false, nil
+	}
+	return true, s.serveBatch(udpConn, ipv4.NewPacketConn(udpConn))
+}
+
+// serveBatch reads up to s.BatchSize datagrams per ReadBatch call,
+// processes each with a pooled request/response pair, and flushes the
+// replies with a single WriteBatch call.
+func (s *Server) serveBatch(c net.PacketConn, pc *ipv4.PacketConn) error {
+	if s.pool.New == nil {
+		s.pool.New = func() interface{} { return s.newMsgPair() }
+	}
+	msgs := make([]ipv4.Message, s.BatchSize)
+	pairs := make([]*msgPair, s.BatchSize)
+	for i := range msgs {
+		pairs[i] = s.acquire()
+		msgs[i].Buffers = [][]byte{pairs[i].buf}
+	}
+	defer func() {
+		for _, p := range pairs {
+			s.release(p)
+		}
+	}()
+
+	out := make([]ipv4.Message, 0, s.BatchSize)
+	for {
+		n, err := pc.ReadBatch(msgs, 0)
+		if err != nil {
+			return err
+		}
+		out = out[:0]
+		for i := 0; i < n; i++ {
+			pair := pairs[i]
+			s.processPacket(c, msgs[i].Addr, pair.buf[:msgs[i].N], pair.req, pair.res)
+			if len(pair.res.Raw) > 0 {
+				out = append(out, ipv4.Message{Buffers: [][]byte{pair.res.Raw}, Addr: msgs[i].Addr})
+			}
+		}
+		if len(out) > 0 {
+			if _, err := pc.WriteBatch(out, 0); err != nil {
+				s.log.Printf("WriteBatch: %v", err)
+			} else {
+				for _, m := range out {
+					bytesSentTotal.Add(float64(len(m.Buffers[0])))
+				}
+			}
+		}
+		for i := 0; i < n; i++ {
+			pairs[i].req.Reset()
+			pairs[i].res.Reset()
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// tryBatchServe is a no-op on platforms without recvmmsg/sendmmsg;
+// callers fall back to Serve's one-datagram-at-a-time path.
+func (s *Server) tryBatchServe(c net.PacketConn) (handled bool, err error) {
+	return false, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"gortc.io/stun"
+)
+
+// BenchmarkServeSingleWorker measures Binding throughput on loopback with
+// the original one-reader-goroutine shape (Workers: 1, the default).
+func BenchmarkServeSingleWorker(b *testing.B) {
+	benchmarkServe(b, 1)
+}
+
+// BenchmarkServeWorkerPool measures the same throughput with several
+// reader goroutines sharing one socket, the case this change adds.
+func BenchmarkServeWorkerPool(b *testing.B) {
+	benchmarkServe(b, 4)
+}
+
+func benchmarkServe(b *testing.B, workers int) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := newServer(Config{Workers: workers})
+	go s.Serve(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	req := new(stun.Message)
+	if err := req.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint); err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(req.Raw)))
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(req.Raw); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := client.Read(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
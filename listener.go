@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"gortc.io/stun"
+)
+
+// stunHeaderLen is the size of the fixed STUN message header: 2 bytes
+// message type, 2 bytes message length, 4 bytes magic cookie and 12 bytes
+// transaction ID. The length field gives the size of the body that
+// follows, which is what frames STUN messages on a stream transport.
+const stunHeaderLen = 20
+
+// TLSConfig names the certificate and key files for a "tls" listener.
+type TLSConfig struct {
+	Cert string `yaml:"Cert"`
+	Key  string `yaml:"Key"`
+}
+
+// ListenerConfig describes a single socket stund should bind, alongside any
+// others in Config.Listeners. Net is one of "udp", "tcp" or "tls".
+type ListenerConfig struct {
+	Net     string     `yaml:"Net"`
+	Address string     `yaml:"Address"`
+	TLS     *TLSConfig `yaml:"TLS,omitempty"`
+}
+
+// ListenAndServeAll binds every listener in specs and serves STUN on each
+// until ctx is cancelled or one of them fails, in which case the rest are
+// stopped and the first error is returned.
+func ListenAndServeAll(ctx context.Context, s *Server, specs []ListenerConfig) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(specs))
+	for _, spec := range specs {
+		spec := spec
+		go func() {
+			errs <- serveOne(ctx, s, spec)
+		}()
+	}
+
+	var first error
+	for range specs {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			cancel()
+		}
+	}
+	return first
+}
+
+func serveOne(ctx context.Context, s *Server, spec ListenerConfig) error {
+	switch spec.Net {
+	case "udp":
+		if s.discovery != nil && normalize(spec.Address) == s.discovery.primaryAddr() {
+			go closeOnDone(ctx, s.discovery)
+			return s.ServeDiscovery()
+		}
+		if s.ReuseAddr && s.workers() > 1 {
+			conns, err := listenUDPReusePort(normalize(spec.Address), s.workers())
+			if err != nil {
+				return errors.Wrapf(err, "listen udp (reuseport) %s", spec.Address)
+			}
+			for _, conn := range conns {
+				go closeOnDone(ctx, conn)
+			}
+			return s.serveConns(conns)
+		}
+		conn, err := net.ListenPacket("udp", normalize(spec.Address))
+		if err != nil {
+			return errors.Wrapf(err, "listen udp %s", spec.Address)
+		}
+		go closeOnDone(ctx, conn)
+		if ok, err := s.tryBatchServe(conn); ok {
+			return err
+		}
+		return s.Serve(conn)
+	case "tcp":
+		l, err := net.Listen("tcp", normalize(spec.Address))
+		if err != nil {
+			return errors.Wrapf(err, "listen tcp %s", spec.Address)
+		}
+		go closeOnDone(ctx, l)
+		return s.ServeListener(l)
+	case "tls":
+		if spec.TLS == nil {
+			return errors.Errorf("tls listener %s: missing TLS.Cert/TLS.Key", spec.Address)
+		}
+		cert, err := tls.LoadX509KeyPair(spec.TLS.Cert, spec.TLS.Key)
+		if err != nil {
+			return errors.Wrapf(err, "load tls keypair for %s", spec.Address)
+		}
+		l, err := tls.Listen("tcp", normalize(spec.Address), &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			return errors.Wrapf(err, "listen tls %s", spec.Address)
+		}
+		go closeOnDone(ctx, l)
+		return s.ServeListener(l)
+	default:
+		return errors.Errorf("unsupported network: %s", spec.Net)
+	}
+}
+
+// listenUDPReusePort opens n UDP sockets on addr with SO_REUSEPORT, so the
+// kernel spreads inbound datagrams across them instead of one goroutine
+// reading them all off a single socket.
+func listenUDPReusePort(addr string, n int) ([]net.PacketConn, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	conns := make([]net.PacketConn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+func closeOnDone(ctx context.Context, c io.Closer) {
+	<-ctx.Done()
+	c.Close()
+}
+
+// ServeListener accepts stream connections from l and serves framed STUN
+// messages on each until l is closed.
+func (s *Server) ServeListener(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveStreamConn(conn)
+	}
+}
+
+// serveStreamConn reads length-delimited STUN messages from conn, using
+// the 20-byte header's length field to find each message boundary, and
+// writes the response back on the same connection.
+func (s *Server) serveStreamConn(conn net.Conn) {
+	defer conn.Close()
+	var (
+		res = new(stun.Message)
+		req = new(stun.Message)
+	)
+	header := make([]byte, stunHeaderLen)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF {
+				s.log.Printf("stream read header: %v", err)
+			}
+			return
+		}
+		bodyLen := binary.BigEndian.Uint16(header[2:4])
+		buf := make([]byte, stunHeaderLen+int(bodyLen))
+		copy(buf, header)
+		if _, err := io.ReadFull(conn, buf[stunHeaderLen:]); err != nil {
+			s.log.Printf("stream read body: %v", err)
+			return
+		}
+		bytesReceivedTotal.Add(float64(len(buf)))
+		start := time.Now()
+		if err := decode(buf, req); err != nil {
+			if err != errNotSTUNMessage {
+				s.log.Printf("decode: %v", err)
+				requestsTotal.WithLabelValues("unknown", "malformed").Inc()
+			}
+			res.Reset()
+			req.Reset()
+			continue
+		}
+		err := s.basicProcess(conn.RemoteAddr(), req, res)
+		s.recordRequest(conn.RemoteAddr(), req.Type.Method.String(), req.TransactionID, res, err, start)
+		if err != nil {
+			s.log.Printf("basicProcess: %v", err)
+			res.Reset()
+			req.Reset()
+			continue
+		}
+		if _, err := conn.Write(res.Raw); err != nil {
+			s.log.Printf("stream write: %v", err)
+			return
+		}
+		bytesSentTotal.Add(float64(len(res.Raw)))
+		res.Reset()
+		req.Reset()
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// configureLogging sets defaultLogger's level from logLevel, defaulting to
+// Info. logAllErrors is the pre-existing "log everything" toggle: when set
+// it forces at least Debug, so LogAllErrors keeps working as a shorthand
+// for operators who don't want to also set LogLevel.
+func configureLogging(logAllErrors bool, logLevel string) {
+	level := logrus.InfoLevel
+	if logLevel != "" {
+		l, err := logrus.ParseLevel(logLevel)
+		if err != nil {
+			log.Printf("invalid LogLevel %q, using default %s: %v", logLevel, level, err)
+		} else {
+			level = l
+		}
+	}
+	if logAllErrors && level < logrus.DebugLevel {
+		level = logrus.DebugLevel
+	}
+	defaultLogger.SetLevel(level)
+}
+
+// logRequest emits one structured debug line per processed request, so
+// operators can trace individual Binding/TURN requests without
+// recompiling. It's a no-op unless the configured level allows Debug.
+func (s *Server) logRequest(addr net.Addr, method string, txID [12]byte, result string, d time.Duration) {
+	defaultLogger.WithFields(logrus.Fields{
+		"src":      addrString(addr),
+		"method":   method,
+		"txid":     hex.EncodeToString(txID[:]),
+		"result":   result,
+		"duration": d,
+	}).Debug("stun request")
+}
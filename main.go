@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	stderrors "errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -9,20 +11,84 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 
 	"gortc.io/stun"
+
+	"github.com/soapjk/stund/turn"
 )
 
 type Config struct {
 	Net     string `yaml:"Net"`
 	Address string `yaml:"Address"`
 	Profile bool   `yaml:"Profile"`
+
+	// Listeners, when non-empty, takes priority over Net/Address and lets
+	// a single stund process bind UDP, TCP and TLS sockets concurrently,
+	// e.g. udp/0.0.0.0:3478, tcp/0.0.0.0:3478 and tls/0.0.0.0:5349.
+	Listeners []ListenerConfig `yaml:"Listeners"`
+
+	// Realm, Users and NonceTTL enable RFC 5389 long-term credential
+	// authentication. Leave Users empty to keep serving anonymously.
+	Realm    string            `yaml:"Realm"`
+	Users    map[string]string `yaml:"Users"`
+	NonceTTL string            `yaml:"NonceTTL"`
+
+	// SecondaryAddress (RFC 5780 "Address2") enables NAT behavior
+	// discovery: stund binds four UDP sockets, primary and secondary IP
+	// each on the primary and alternate port, advertises the alternate
+	// pair via OTHER-ADDRESS, and honors CHANGE-REQUEST. It requires the
+	// legacy Net/Address form: discovery's four-socket quad is bound from
+	// Address/SecondaryAddress directly and has no way to pick one
+	// matching entry out of Listeners, so the two are mutually exclusive.
+	SecondaryAddress string `yaml:"SecondaryAddress"`
+
+	// TURN enables the RFC 5766 relay subsystem. It requires Users to be
+	// set, since TURN mandates long-term credentials.
+	TURN TURNConfig `yaml:"TURN"`
+
+	// Workers is the number of reader goroutines per UDP socket. Defaults
+	// to 1. ReuseAddr opens Workers separate SO_REUSEPORT sockets instead
+	// of sharing one, letting the kernel load-balance across them
+	// (Linux only). BatchSize, if set, reads and writes up to that many
+	// UDP datagrams per syscall via recvmmsg/sendmmsg (Linux only); a
+	// batched socket is read by a single goroutine regardless of Workers,
+	// and BatchSize is not used when ReuseAddr opens several sockets.
+	Workers   int  `yaml:"Workers"`
+	ReuseAddr bool `yaml:"ReuseAddr"`
+	BatchSize int  `yaml:"BatchSize"`
+
+	// Metrics exposes a Prometheus /metrics endpoint on its own address.
+	// /metrics is also always registered on the pprof mux started by
+	// Profile, regardless of this setting.
+	Metrics MetricsConfig `yaml:"Metrics"`
+
+	// LogAllErrors, kept for backwards compatibility, is shorthand for
+	// LogLevel: "debug". LogLevel takes a logrus level name ("debug",
+	// "info", "warn", ...) and controls the per-request structured log
+	// line Server emits for every processed request.
+	LogAllErrors bool   `yaml:"LogAllErrors"`
+	LogLevel     string `yaml:"LogLevel"`
+}
+
+// TURNConfig configures the optional TURN relay.
+type TURNConfig struct {
+	Enabled         bool   `yaml:"Enabled"`
+	MinPort         int    `yaml:"MinPort"`
+	MaxPort         int    `yaml:"MaxPort"`
+	MaxAllocations  int    `yaml:"MaxAllocations"`
+	DefaultLifetime string `yaml:"DefaultLifetime"`
 }
 
+const defaultNonceTTL = 5 * time.Minute
+const defaultRealm = "stund"
+
 var (
 	network     = flag.String("net", "udp", "network to listen")
 	address     = flag.String("addr", "0.0.0.0:3479", "address to listen")
@@ -32,13 +98,73 @@ var (
 
 // Server is RFC 5389 basic server implementation.
 //
-// Current implementation is UDP only and not utilizes FINGERPRINT mechanism,
-// nor ALTERNATE-SERVER, nor credentials mechanisms. It does not support
-// backwards compatibility with RFC 3489.
+// Current implementation serves UDP, TCP and TLS and does not utilize
+// ALTERNATE-SERVER. It does not support backwards compatibility with RFC 3489.
+//
+// If Auth is set, the server requires RFC 5389 long-term credentials on
+// every Binding request: a request without a valid MESSAGE-INTEGRITY is
+// challenged with a 401 Unauthorized carrying REALM and a fresh NONCE,
+// otherwise MESSAGE-INTEGRITY is verified and appended to the response.
 type Server struct {
 	Addr         string
 	LogAllErrors bool
 	log          Logger
+
+	// Realm, Auth and Nonces together enable long-term credential
+	// authentication. Auth is nil in anonymous mode.
+	Realm  string
+	Auth   Authenticator
+	Nonces *nonceStore
+
+	// discovery holds the four-socket quad used for RFC 5780 NAT behavior
+	// discovery. Nil unless Config.SecondaryAddress is set.
+	discovery *discoveryConns
+
+	// turn handles Allocate/Refresh/CreatePermission/ChannelBind/Send/Data
+	// on top of the Binding server. Nil unless Config.TURN.Enabled is set.
+	turn *turn.Allocator
+
+	// Workers, ReuseAddr and BatchSize mirror the Config fields of the
+	// same name; see newServer.
+	Workers   int
+	ReuseAddr bool
+	BatchSize int
+
+	pool sync.Pool // of *msgPair
+}
+
+// msgPair is a reusable request/response message plus its read buffer,
+// pooled to keep Serve's hot path allocation-free.
+type msgPair struct {
+	req *stun.Message
+	res *stun.Message
+	buf []byte
+}
+
+func (s *Server) newMsgPair() *msgPair {
+	return &msgPair{
+		req: new(stun.Message),
+		res: new(stun.Message),
+		buf: make([]byte, 1500),
+	}
+}
+
+func (s *Server) acquire() *msgPair {
+	return s.pool.Get().(*msgPair)
+}
+
+func (s *Server) release(p *msgPair) {
+	p.req.Reset()
+	p.res.Reset()
+	s.pool.Put(p)
+}
+
+// workers returns the configured reader goroutine count, defaulting to 1.
+func (s *Server) workers() int {
+	if s.Workers > 0 {
+		return s.Workers
+	}
+	return 1
 }
 
 // Logger is used for logging formatted messages.
@@ -53,90 +179,264 @@ var (
 	errNotSTUNMessage = errors.New("not stun message")
 )
 
-func basicProcess(addr net.Addr, b []byte, req, res *stun.Message) error {
+// decode reads a raw STUN message from b into req.
+func decode(b []byte, req *stun.Message) error {
 	if !stun.IsMessage(b) {
 		return errNotSTUNMessage
 	}
 	if _, err := req.Write(b); err != nil {
 		return errors.Wrap(err, "failed to read message")
 	}
-	var (
-		ip   net.IP
-		port int
-	)
+	return nil
+}
+
+// addrIPPort splits addr into its IP and port, as reported by the
+// net.PacketConn/net.Conn the request arrived on.
+func addrIPPort(addr net.Addr) (net.IP, int) {
 	switch a := addr.(type) {
 	case *net.UDPAddr:
-		ip = a.IP
-		port = a.Port
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
 	default:
 		panic(fmt.Sprintf("unknown addr: %v", addr))
 	}
-	return res.Build(req,
+}
+
+// basicProcess answers a decoded Binding request in req with a success
+// response in res, carrying XOR-MAPPED-ADDRESS plus any extra attributes
+// (e.g. OTHER-ADDRESS, RESPONSE-ORIGIN for RFC 5780 discovery). If the
+// server requires authentication, it verifies MESSAGE-INTEGRITY and signs
+// the response, or replies with a 401 challenge instead.
+func (s *Server) basicProcess(addr net.Addr, req, res *stun.Message, extra ...stun.Setter) error {
+	ip, port := addrIPPort(addr)
+	setters := append([]stun.Setter{
+		req,
 		stun.BindingSuccess,
 		software,
-		&stun.XORMappedAddress{
-			IP:   ip,
-			Port: port,
-		},
-		stun.Fingerprint,
-	)
+		&stun.XORMappedAddress{IP: ip, Port: port},
+	}, extra...)
+	if s.Auth != nil {
+		key, ok := s.authenticate(req)
+		if !ok {
+			return s.challenge(req, res)
+		}
+		setters = append(setters, stun.MessageIntegrity(key))
+	}
+	setters = append(setters, stun.Fingerprint)
+	return res.Build(setters...)
 }
 
-func (s *Server) serveConn(c net.PacketConn, res, req *stun.Message) error {
+// processPacket answers one datagram read into buf from addr, dispatching
+// to TURN when applicable and otherwise to basicProcess. It leaves res
+// empty when there is nothing to write back (bad message, TURN
+// indication, TURN channeldata). Every decoded request and every
+// ChannelData message records stund_requests_total,
+// stund_response_seconds and a structured per-request debug log line; a
+// malformed STUN message only counts as method "unknown", result
+// "malformed", and non-STUN data is only counted in bytes received.
+func (s *Server) processPacket(c net.PacketConn, addr net.Addr, buf []byte, req, res *stun.Message) {
+	start := time.Now()
+	bytesReceivedTotal.Add(float64(len(buf)))
+
+	if s.turn != nil && turn.IsChannelData(buf) {
+		err := s.turn.HandleChannelData(addr, buf)
+		s.recordRequest(addr, "channeldata", [stun.TransactionIDSize]byte{}, nil, err, start)
+		if err != nil {
+			s.log.Printf("turn channeldata: %v", err)
+		}
+		return
+	}
+	if err := decode(buf, req); err != nil {
+		if err != errNotSTUNMessage {
+			s.log.Printf("decode: %v", err)
+			requestsTotal.WithLabelValues("unknown", "malformed").Inc()
+		}
+		return
+	}
+	if s.turn != nil && turn.IsTURNMethod(req.Type.Method) {
+		err := s.turn.Handle(addr, c, req, res)
+		s.recordRequest(addr, req.Type.Method.String(), req.TransactionID, res, err, start)
+		if err != nil {
+			s.log.Printf("turn: %v", err)
+		}
+		return
+	}
+	err := s.basicProcess(addr, req, res)
+	s.recordRequest(addr, req.Type.Method.String(), req.TransactionID, res, err, start)
+	if err != nil {
+		s.log.Printf("basicProcess: %v", err)
+	}
+}
+
+// recordRequest updates the requests/response-time metrics and emits the
+// per-request structured log line for one processed message. result is
+// "error" if handling itself failed or if it built a STUN error response
+// (e.g. a 401 challenge), "success" otherwise. res is nil when no STUN
+// message was built for this request (e.g. TURN ChannelData).
+func (s *Server) recordRequest(addr net.Addr, method string, txID [stun.TransactionIDSize]byte, res *stun.Message, err error, start time.Time) {
+	result := "success"
+	if err != nil || (res != nil && isErrorResponse(res)) {
+		result = "error"
+	}
+	d := time.Since(start)
+	responseSeconds.Observe(d.Seconds())
+	requestsTotal.WithLabelValues(method, result).Inc()
+	s.logRequest(addr, method, txID, result, d)
+}
+
+func (s *Server) serveConn(c net.PacketConn) error {
 	if c == nil {
 		return nil
 	}
-	buf := make([]byte, 1024)
-	n, addr, err := c.ReadFrom(buf)
+	pair := s.acquire()
+	defer s.release(pair)
+
+	n, addr, err := c.ReadFrom(pair.buf)
 	if err != nil {
+		if stderrors.Is(err, net.ErrClosed) {
+			return err
+		}
 		s.log.Printf("ReadFrom: %v", err)
 		return nil
 	}
-	// s.log().Printf("read %d bytes from %s", n, addr)
-	if _, err = req.Write(buf[:n]); err != nil {
-		s.log.Printf("Write: %v", err)
-		return err
-	}
-	if err = basicProcess(addr, buf[:n], req, res); err != nil {
-		if err == errNotSTUNMessage {
-			return nil
-		}
-		s.log.Printf("basicProcess: %v", err)
+	s.processPacket(c, addr, pair.buf[:n], pair.req, pair.res)
+	if len(pair.res.Raw) == 0 {
 		return nil
 	}
-	_, err = c.WriteTo(res.Raw, addr)
-	if err != nil {
+	if _, err := c.WriteTo(pair.res.Raw, addr); err != nil {
 		s.log.Printf("WriteTo: %v", err)
+	} else {
+		bytesSentTotal.Add(float64(len(pair.res.Raw)))
 	}
-	return err
+	return nil
 }
 
-// Serve reads packets from connections and responds to BINDING requests.
+// Serve launches workers() reader goroutines on c, each processing
+// datagrams with a pooled request/response pair, and blocks until one of
+// them stops.
 func (s *Server) Serve(c net.PacketConn) error {
-	var (
-		res = new(stun.Message)
-		req = new(stun.Message)
-	)
+	return s.serveConns([]net.PacketConn{c})
+}
+
+// serveConns is Serve for multiple sockets sharing one Server, as used for
+// a set of SO_REUSEPORT sockets on the same address.
+func (s *Server) serveConns(conns []net.PacketConn) error {
+	if s.pool.New == nil {
+		s.pool.New = func() interface{} { return s.newMsgPair() }
+	}
+	errs := make(chan error, len(conns)*s.workers())
+	for _, c := range conns {
+		c := c
+		for i := 0; i < s.workers(); i++ {
+			go func() {
+				errs <- s.serveLoop(c)
+			}()
+		}
+	}
+	return <-errs
+}
+
+func (s *Server) serveLoop(c net.PacketConn) error {
 	for {
-		if err := s.serveConn(c, res, req); err != nil {
+		if err := s.serveConn(c); err != nil {
 			s.log.Printf("serve: %v", err)
 			return err
 		}
-		res.Reset()
-		req.Reset()
 	}
 }
 
-// ListenUDPAndServe listens on laddr and process incoming packets.
-func ListenUDPAndServe(serverNet, laddr string) error {
-	c, err := net.ListenPacket(serverNet, laddr)
-	if err != nil {
-		return err
+// listenerSpecs returns the sockets stund should bind for c: c.Listeners
+// if set, otherwise a single legacy entry built from c.Net/c.Address.
+func listenerSpecs(c Config) []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
 	}
+	return []ListenerConfig{{Net: c.Net, Address: c.Address}}
+}
+
+// newServer builds a Server from c, wiring up long-term credential
+// authentication when c.Users is non-empty.
+func newServer(c Config) *Server {
+	configureLogging(c.LogAllErrors, c.LogLevel)
 	s := &Server{
-		log: defaultLogger,
+		log:          defaultLogger,
+		LogAllErrors: c.LogAllErrors,
+		Workers:      c.Workers,
+		ReuseAddr:    c.ReuseAddr,
+		BatchSize:    c.BatchSize,
+	}
+	s.pool.New = func() interface{} { return s.newMsgPair() }
+	if len(c.Users) == 0 {
+		return s
 	}
-	return s.Serve(c)
+	s.Realm = c.Realm
+	if s.Realm == "" {
+		s.Realm = defaultRealm
+	}
+	ttl := defaultNonceTTL
+	if c.NonceTTL != "" {
+		d, err := time.ParseDuration(c.NonceTTL)
+		if err != nil {
+			log.Printf("invalid NonceTTL %q, using default %s: %v", c.NonceTTL, defaultNonceTTL, err)
+		} else {
+			ttl = d
+		}
+	}
+	s.Auth = newStaticAuthenticator(s.Realm, c.Users)
+	s.Nonces = newNonceStore(ttl)
+	return s
+}
+
+// newDiscoveryServer extends s in place with an RFC 5780 discovery quad
+// when c.SecondaryAddress is set, logging and falling back to a plain
+// Binding server if the extra sockets can't be bound or if c.Listeners is
+// in use, since discovery only knows how to bind Address/SecondaryAddress.
+func newDiscoveryServer(s *Server, c Config) {
+	if c.SecondaryAddress == "" {
+		return
+	}
+	if len(c.Listeners) > 0 {
+		log.Printf("disabling NAT behavior discovery: SecondaryAddress requires the legacy Net/Address form, not Listeners")
+		return
+	}
+	d, err := newDiscoveryConns(normalize(c.Address), normalize(c.SecondaryAddress))
+	if err != nil {
+		log.Printf("disabling NAT behavior discovery: %v", err)
+		return
+	}
+	s.discovery = d
+}
+
+// newTURNAllocator builds the TURN relay from c.TURN, reusing s's
+// authenticator and nonce store since TURN requires the same long-term
+// credentials as the STUN server. Returns nil if TURN is disabled or the
+// server has no authenticator configured.
+func newTURNAllocator(s *Server, c Config) *turn.Allocator {
+	if !c.TURN.Enabled {
+		return nil
+	}
+	if s.Auth == nil {
+		log.Printf("disabling TURN: requires Users to be configured for long-term credentials")
+		return nil
+	}
+	lifetime := 10 * time.Minute
+	if c.TURN.DefaultLifetime != "" {
+		d, err := time.ParseDuration(c.TURN.DefaultLifetime)
+		if err != nil {
+			log.Printf("invalid TURN.DefaultLifetime %q, using default %s: %v", c.TURN.DefaultLifetime, lifetime, err)
+		} else {
+			lifetime = d
+		}
+	}
+	allocator := turn.NewAllocator(turn.Config{
+		MinPort:         c.TURN.MinPort,
+		MaxPort:         c.TURN.MaxPort,
+		MaxAllocations:  c.TURN.MaxAllocations,
+		DefaultLifetime: lifetime,
+	}, s.Auth, s.Nonces, s.Realm)
+	registerTURNGauges(allocator)
+	return allocator
 }
 
 func normalize(address string) string {
@@ -165,17 +465,29 @@ func main() {
 		}
 		log.Printf("load config file:%+v",_config)
 	}
+	http.Handle("/metrics", promhttp.Handler())
 	if _config.Profile {
 		go func() {
 			log.Println(http.ListenAndServe("localhost:6060", nil))
 		}()
 	}
-	switch _config.Net {
-	case "udp":
-		normalized := normalize(_config.Address)
-		fmt.Println("gortc/stund listening on", normalized, "via", _config.Net)
-		log.Fatal(ListenUDPAndServe(_config.Net, normalized))
-	default:
-		log.Fatalln("unsupported network:", _config.Net)
+	if _config.Metrics.Enabled {
+		addr := _config.Metrics.Address
+		if addr == "" {
+			addr = defaultMetricsAddress
+		}
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			log.Println(http.ListenAndServe(addr, mux))
+		}()
+	}
+	specs := listenerSpecs(_config)
+	for _, spec := range specs {
+		fmt.Println("gortc/stund listening on", normalize(spec.Address), "via", spec.Net)
 	}
+	s := newServer(_config)
+	newDiscoveryServer(s, _config)
+	s.turn = newTURNAllocator(s, _config)
+	log.Fatal(ListenAndServeAll(context.Background(), s, specs))
 }
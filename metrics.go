@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"gortc.io/stun"
+)
+
+// MetricsConfig configures the optional dedicated Prometheus endpoint.
+// /metrics is also always registered on the pprof mux started when
+// Profile is set, independent of this.
+type MetricsConfig struct {
+	Enabled bool   `yaml:"Enabled"`
+	Address string `yaml:"Address"`
+}
+
+const defaultMetricsAddress = "localhost:9090"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stund_requests_total",
+		Help: "STUN/TURN requests processed, by method and result.",
+	}, []string{"method", "result"})
+
+	bytesReceivedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "stund_bytes_received_total",
+		Help: "Bytes read off the wire.",
+	})
+
+	bytesSentTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "stund_bytes_sent_total",
+		Help: "Bytes written to the wire.",
+	})
+
+	responseSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "stund_response_seconds",
+		Help:    "Time spent handling a request and building its response, excluding the write.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// turnGaugeSource is the subset of *turn.Allocator the TURN gauges below
+// need; declared here rather than imported so metrics.go doesn't need to
+// know about the turn package's other exports.
+type turnGaugeSource interface {
+	Allocations() int
+	Channels() int
+}
+
+// registerTURNGauges exposes live allocation/channel bindings counts from
+// a. The values are read on scrape, not pushed, so there is nothing to
+// update when they change.
+func registerTURNGauges(a turnGaugeSource) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "stund_turn_allocations_active",
+		Help: "Active TURN allocations.",
+	}, func() float64 { return float64(a.Allocations()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "stund_turn_channels_active",
+		Help: "Active TURN channel bindings.",
+	}, func() float64 { return float64(a.Channels()) })
+}
+
+func isErrorResponse(m *stun.Message) bool {
+	return m.Type.Class == stun.ClassErrorResponse
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
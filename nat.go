@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"gortc.io/stun"
+
+	"github.com/soapjk/stund/turn"
+)
+
+// RFC 5780 attribute numbers not carried by the base RFC 5389 package.
+const (
+	attrChangeRequest  stun.AttrType = 0x0003
+	attrResponseOrigin stun.AttrType = 0x802b
+	attrOtherAddress   stun.AttrType = 0x802c
+)
+
+// CHANGE-REQUEST flag bits (RFC 5780 Section 7.2).
+const (
+	changeIPFlag   = 0x4
+	changePortFlag = 0x2
+)
+
+// changeRequest reflects whether the client asked for the response to
+// come from a different IP, a different port, or both.
+type changeRequest struct {
+	ip, port bool
+}
+
+func getChangeRequest(req *stun.Message) changeRequest {
+	raw, ok := req.Attributes.Get(attrChangeRequest)
+	if !ok || len(raw.Value) < 4 {
+		return changeRequest{}
+	}
+	flags := binary.BigEndian.Uint32(raw.Value)
+	return changeRequest{
+		ip:   flags&changeIPFlag != 0,
+		port: flags&changePortFlag != 0,
+	}
+}
+
+// addressAttr encodes an RFC 5389 MAPPED-ADDRESS-shaped attribute (family,
+// port, address, none of it XOR'd) under an arbitrary attribute number, as
+// used by OTHER-ADDRESS and RESPONSE-ORIGIN.
+type addressAttr struct {
+	typ  stun.AttrType
+	ip   net.IP
+	port int
+}
+
+func otherAddress(ip net.IP, port int) stun.Setter {
+	return addressAttr{typ: attrOtherAddress, ip: ip, port: port}
+}
+
+func responseOrigin(ip net.IP, port int) stun.Setter {
+	return addressAttr{typ: attrResponseOrigin, ip: ip, port: port}
+}
+
+func (a addressAttr) AddTo(m *stun.Message) error {
+	family := byte(0x01)
+	ip := a.ip.To4()
+	if ip == nil {
+		family = 0x02
+		if ip = a.ip.To16(); ip == nil {
+			return errors.Errorf("bad IP: %v", a.ip)
+		}
+	}
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(a.port))
+	copy(value[4:], ip)
+	m.Add(a.typ, value)
+	return nil
+}
+
+// discoveryConns is the four-socket quad an RFC 5780 discovery server
+// needs: primary and secondary IP, each bound on the primary and the
+// alternate port, indexed conns[ipIndex][portIndex].
+type discoveryConns struct {
+	conns [2][2]net.PacketConn
+}
+
+// newDiscoveryConns binds the quad for primary and secondary addresses,
+// each "host:port". The primary port comes from primary, the alternate
+// port from secondary; each host is paired with both ports.
+func newDiscoveryConns(primary, secondary string) (*discoveryConns, error) {
+	pHost, pPort, err := net.SplitHostPort(primary)
+	if err != nil {
+		return nil, errors.Wrapf(err, "primary address %s", primary)
+	}
+	sHost, sPort, err := net.SplitHostPort(secondary)
+	if err != nil {
+		return nil, errors.Wrapf(err, "secondary address %s", secondary)
+	}
+	hosts := [2]string{pHost, sHost}
+	ports := [2]string{pPort, sPort}
+
+	var d discoveryConns
+	for i, host := range hosts {
+		for j, port := range ports {
+			addr := net.JoinHostPort(host, port)
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				d.Close()
+				return nil, errors.Wrapf(err, "listen udp %s", addr)
+			}
+			d.conns[i][j] = conn
+		}
+	}
+	return &d, nil
+}
+
+// Close closes every socket in the quad. Safe to call on a partially
+// initialized quad.
+func (d *discoveryConns) Close() error {
+	for i := range d.conns {
+		for j := range d.conns[i] {
+			if d.conns[i][j] != nil {
+				d.conns[i][j].Close()
+			}
+		}
+	}
+	return nil
+}
+
+// primaryAddr is the address of conns[0][0], the socket an ordinary
+// "udp" listener spec should be routed to when discovery is enabled.
+func (d *discoveryConns) primaryAddr() string {
+	return d.conns[0][0].LocalAddr().String()
+}
+
+func (d *discoveryConns) localAddr(i, j int) (net.IP, int) {
+	addr := d.conns[i][j].LocalAddr().(*net.UDPAddr)
+	return addr.IP, addr.Port
+}
+
+// ServeDiscovery serves RFC 5780 NAT behavior discovery across the
+// server's four sockets until one of them stops, then closes the rest.
+func (s *Server) ServeDiscovery() error {
+	errs := make(chan error, 4)
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			i, j := i, j
+			go func() {
+				errs <- s.serveDiscoverySocket(i, j)
+			}()
+		}
+	}
+	err := <-errs
+	s.discovery.Close()
+	for k := 0; k < 3; k++ {
+		<-errs
+	}
+	return err
+}
+
+func (s *Server) serveDiscoverySocket(i, j int) error {
+	conn := s.discovery.conns[i][j]
+	var (
+		res = new(stun.Message)
+		req = new(stun.Message)
+	)
+	buf := make([]byte, 1024)
+	for {
+		if err := s.serveDiscoveryConn(i, j, conn, buf, req, res); err != nil {
+			return err
+		}
+		res.Reset()
+		req.Reset()
+	}
+}
+
+// serveDiscoveryConn reads one request from conns[i][j]. TURN requests (if
+// TURN is enabled) are handed to the allocator same as on the primary
+// listener; everything else is answered as a Binding response with
+// OTHER-ADDRESS and RESPONSE-ORIGIN attached, and sent from whichever
+// socket CHANGE-REQUEST asks for. Like processPacket, every decoded request
+// and ChannelData message updates stund_requests_total/stund_bytes_*/
+// stund_response_seconds and emits a structured per-request log line via
+// recordRequest; undecodable input only updates the byte and malformed
+// counters.
+func (s *Server) serveDiscoveryConn(i, j int, conn net.PacketConn, buf []byte, req, res *stun.Message) error {
+	start := time.Now()
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		s.log.Printf("ReadFrom: %v", err)
+		return err
+	}
+	bytesReceivedTotal.Add(float64(n))
+
+	if s.turn != nil && turn.IsChannelData(buf[:n]) {
+		err := s.turn.HandleChannelData(addr, buf[:n])
+		s.recordRequest(addr, "channeldata", [stun.TransactionIDSize]byte{}, nil, err, start)
+		if err != nil {
+			s.log.Printf("turn channeldata: %v", err)
+		}
+		return nil
+	}
+	if err = decode(buf[:n], req); err != nil {
+		if err != errNotSTUNMessage {
+			s.log.Printf("decode: %v", err)
+			requestsTotal.WithLabelValues("unknown", "malformed").Inc()
+		}
+		return nil
+	}
+
+	var target net.PacketConn
+	if s.turn != nil && turn.IsTURNMethod(req.Type.Method) {
+		target = conn
+		err = s.turn.Handle(addr, conn, req, res)
+		s.recordRequest(addr, req.Type.Method.String(), req.TransactionID, res, err, start)
+		if err != nil {
+			s.log.Printf("turn: %v", err)
+			return nil
+		}
+	} else {
+		cr := getChangeRequest(req)
+		ti, tj := i, j
+		if cr.ip {
+			ti = 1 - i
+		}
+		if cr.port {
+			tj = 1 - j
+		}
+		target = s.discovery.conns[ti][tj]
+
+		otherIP, otherPort := s.discovery.localAddr(1-i, 1-j)
+		originIP, originPort := s.discovery.localAddr(ti, tj)
+		err = s.basicProcess(addr, req, res,
+			otherAddress(otherIP, otherPort),
+			responseOrigin(originIP, originPort),
+		)
+		s.recordRequest(addr, req.Type.Method.String(), req.TransactionID, res, err, start)
+		if err != nil {
+			s.log.Printf("basicProcess: %v", err)
+			return nil
+		}
+	}
+
+	if len(res.Raw) == 0 {
+		return nil
+	}
+	if _, err = target.WriteTo(res.Raw, addr); err != nil {
+		s.log.Printf("WriteTo: %v", err)
+	} else {
+		bytesSentTotal.Add(float64(len(res.Raw)))
+	}
+	return nil
+}
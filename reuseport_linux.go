@@ -0,0 +1,23 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortControl sets SO_REUSEPORT on newly created sockets, letting the
+// kernel load-balance datagrams across several sockets bound to the same
+// address. Passed as a net.ListenConfig.Control hook.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var setErr error
+	err := c.Control(func(fd uintptr) {
+		setErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return setErr
+}
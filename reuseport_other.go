@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// reusePortControl is a stub on platforms without SO_REUSEPORT: it always
+// fails, so a ReuseAddr listener with more than one worker cannot be
+// opened here and serveOne returns the listen error.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is only supported on linux")
+}
@@ -0,0 +1,129 @@
+package turn
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// permissionTTL is how long a CreatePermission installs a permission for,
+// per RFC 5766 Section 8.
+const permissionTTL = 5 * time.Minute
+
+// channelTTL is how long a channel binding lasts, per RFC 5766 Section 11.
+const channelTTL = 10 * time.Minute
+
+// allocation is a single client's relayed UDP socket and the permissions
+// and channel bindings installed on top of it.
+type allocation struct {
+	client     net.Addr
+	relay      net.PacketConn
+	clientConn net.PacketConn // server socket used to reach client
+
+	mu          sync.Mutex
+	expiresAt   time.Time
+	permissions map[string]time.Time // peer IP -> expiry
+	channels    map[uint16]net.Addr  // channel number -> peer
+	channelsRev map[string]uint16    // peer addr -> channel number
+
+	heapIndex int // position in the Allocator's expiry heap
+}
+
+func newAllocation(client net.Addr, clientConn, relay net.PacketConn, lifetime time.Duration) *allocation {
+	return &allocation{
+		client:      client,
+		relay:       relay,
+		clientConn:  clientConn,
+		expiresAt:   time.Now().Add(lifetime),
+		permissions: make(map[string]time.Time),
+		channels:    make(map[uint16]net.Addr),
+		channelsRev: make(map[string]uint16),
+	}
+}
+
+func (a *allocation) refresh(lifetime time.Duration) {
+	a.mu.Lock()
+	a.expiresAt = time.Now().Add(lifetime)
+	a.mu.Unlock()
+}
+
+func (a *allocation) expired() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return time.Now().After(a.expiresAt)
+}
+
+func (a *allocation) permit(peerIP net.IP) {
+	a.mu.Lock()
+	a.permissions[peerIP.String()] = time.Now().Add(permissionTTL)
+	a.mu.Unlock()
+}
+
+func (a *allocation) permitted(peerIP net.IP) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	exp, ok := a.permissions[peerIP.String()]
+	return ok && time.Now().Before(exp)
+}
+
+func (a *allocation) bindChannel(number uint16, peer net.Addr) {
+	a.mu.Lock()
+	a.channels[number] = peer
+	a.channelsRev[peer.String()] = number
+	a.permissions[addrIP(peer).String()] = time.Now().Add(channelTTL)
+	a.mu.Unlock()
+}
+
+func (a *allocation) peerForChannel(number uint16) (net.Addr, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	peer, ok := a.channels[number]
+	return peer, ok
+}
+
+func (a *allocation) channelForPeer(peer net.Addr) (uint16, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n, ok := a.channelsRev[peer.String()]
+	return n, ok
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
+
+// expiryHeap orders allocations by expiresAt so Allocator can wake up for
+// exactly the next one due, rather than polling the whole table.
+type expiryHeap []*allocation
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool {
+	return h[i].expiresAt.Before(h[j].expiresAt)
+}
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	a := x.(*allocation)
+	a.heapIndex = len(*h)
+	*h = append(*h, a)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	a := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return a
+}
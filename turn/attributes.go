@@ -0,0 +1,130 @@
+package turn
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+	"gortc.io/stun"
+)
+
+// TURN attribute numbers not carried by the base RFC 5389 package
+// (RFC 5766 Section 14).
+const (
+	attrChannelNumber      stun.AttrType = 0x000c
+	attrLifetime           stun.AttrType = 0x000d
+	attrXORPeerAddress     stun.AttrType = 0x0012
+	attrData               stun.AttrType = 0x0013
+	attrXORRelayedAddress  stun.AttrType = 0x0016
+	attrRequestedTransport stun.AttrType = 0x0019
+)
+
+// requestedTransportUDP is the only REQUESTED-TRANSPORT value RFC 5766
+// defines: the IANA protocol number for UDP.
+const requestedTransportUDP = 17
+
+const magicCookie = 0x2112a442
+
+// xorAddress encodes an RFC 5389 Section 15.2 XOR-MAPPED-ADDRESS-shaped
+// attribute, used here for XOR-RELAYED-ADDRESS and XOR-PEER-ADDRESS.
+type xorAddress struct {
+	typ  stun.AttrType
+	ip   net.IP
+	port int
+}
+
+func (x xorAddress) AddTo(m *stun.Message) error {
+	family := byte(0x01)
+	ip := x.ip.To4()
+	if ip == nil {
+		family = 0x02
+		if ip = x.ip.To16(); ip == nil {
+			return errors.Errorf("bad IP: %v", x.ip)
+		}
+	}
+	pad := xorPad(m.TransactionID)
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(x.port)^uint16(magicCookie>>16))
+	for i := range ip {
+		value[4+i] = ip[i] ^ pad[i]
+	}
+	m.Add(x.typ, value)
+	return nil
+}
+
+func xorPad(transactionID [stun.TransactionIDSize]byte) [16]byte {
+	var pad [16]byte
+	binary.BigEndian.PutUint32(pad[0:4], magicCookie)
+	copy(pad[4:], transactionID[:])
+	return pad
+}
+
+// getXORAddress decodes an XOR-RELAYED-ADDRESS/XOR-PEER-ADDRESS-shaped
+// attribute from m, if present.
+func getXORAddress(m *stun.Message, t stun.AttrType) (ip net.IP, port int, ok bool) {
+	raw, found := m.Attributes.Get(t)
+	if !found || len(raw.Value) < 4 {
+		return nil, 0, false
+	}
+	pad := xorPad(m.TransactionID)
+	port = int(binary.BigEndian.Uint16(raw.Value[2:4]) ^ uint16(magicCookie>>16))
+	addrBytes := raw.Value[4:]
+	ip = make(net.IP, len(addrBytes))
+	for i := range addrBytes {
+		ip[i] = addrBytes[i] ^ pad[i]
+	}
+	return ip, port, true
+}
+
+// lifetime is the LIFETIME attribute, in whole seconds.
+type lifetime uint32
+
+func (l lifetime) AddTo(m *stun.Message) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(l))
+	m.Add(attrLifetime, v)
+	return nil
+}
+
+// getLifetime reads the LIFETIME attribute from m, if present.
+func getLifetime(m *stun.Message) (lifetime, bool) {
+	raw, ok := m.Attributes.Get(attrLifetime)
+	if !ok || len(raw.Value) < 4 {
+		return 0, false
+	}
+	return lifetime(binary.BigEndian.Uint32(raw.Value)), true
+}
+
+// getChannelNumber reads the CHANNEL-NUMBER attribute from m, if present.
+func getChannelNumber(m *stun.Message) (uint16, bool) {
+	raw, ok := m.Attributes.Get(attrChannelNumber)
+	if !ok || len(raw.Value) < 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(raw.Value), true
+}
+
+// getData reads the DATA attribute from m, if present.
+func getData(m *stun.Message) ([]byte, bool) {
+	raw, ok := m.Attributes.Get(attrData)
+	return raw.Value, ok
+}
+
+// dataAttr is the DATA attribute, carrying a relayed payload.
+type dataAttr []byte
+
+func (d dataAttr) AddTo(m *stun.Message) error {
+	m.Add(attrData, d)
+	return nil
+}
+
+// requestedTransportOK reports whether req's REQUESTED-TRANSPORT is UDP,
+// the only value RFC 5766 allows.
+func requestedTransportOK(req *stun.Message) bool {
+	raw, ok := req.Attributes.Get(attrRequestedTransport)
+	if !ok || len(raw.Value) < 1 {
+		return false
+	}
+	return raw.Value[0] == requestedTransportUDP
+}
@@ -0,0 +1,523 @@
+// Package turn implements an RFC 5766 TURN relay that layers on top of an
+// existing STUN server: Allocate, Refresh, CreatePermission, ChannelBind,
+// and the Send/Data indications, plus the 0x4000-0x7FFF ChannelData fast
+// path. It does not speak STUN Binding itself; callers dispatch Binding
+// requests elsewhere and hand everything else to an Allocator.
+package turn
+
+import (
+	"container/heap"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gortc.io/stun"
+)
+
+// TURN method codes (RFC 5766 Section 13).
+const (
+	MethodAllocate         stun.Method = 0x003
+	MethodRefresh          stun.Method = 0x004
+	MethodSend             stun.Method = 0x006
+	MethodData             stun.Method = 0x007
+	MethodCreatePermission stun.Method = 0x008
+	MethodChannelBind      stun.Method = 0x009
+)
+
+// TURN error codes used below (RFC 5766 Section 17).
+const (
+	codeForbidden            = 403
+	codeAllocationMismatch   = 437
+	codeInsufficientCapacity = 508
+)
+
+// minChannelNumber and maxChannelNumber bound the ChannelData fast-path
+// range (RFC 5766 Section 11).
+const (
+	minChannelNumber = 0x4000
+	maxChannelNumber = 0x7fff
+)
+
+// IsTURNMethod reports whether m is one of the TURN methods Allocator
+// handles, as opposed to STUN Binding.
+func IsTURNMethod(m stun.Method) bool {
+	switch m {
+	case MethodAllocate, MethodRefresh, MethodSend, MethodData, MethodCreatePermission, MethodChannelBind:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsChannelData reports whether b looks like a ChannelData message (RFC
+// 5766 Section 11.4) rather than a STUN message: its first two bytes hold
+// a channel number in [0x4000, 0x7FFF].
+func IsChannelData(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	n := uint16(b[0])<<8 | uint16(b[1])
+	return n >= minChannelNumber && n <= maxChannelNumber
+}
+
+// Authenticator resolves the long-term credential key for a username in a
+// realm. It has the same shape as the STUN server's Authenticator so a
+// single implementation (and user table) serves both.
+type Authenticator interface {
+	Lookup(username, realm string) (key []byte, ok bool)
+}
+
+// NonceStore issues and validates server nonces, as used by the STUN
+// server's long-term credential challenge.
+type NonceStore interface {
+	New() string
+	Valid(nonce string) bool
+}
+
+// Config configures an Allocator.
+type Config struct {
+	MinPort         int
+	MaxPort         int
+	MaxAllocations  int
+	DefaultLifetime time.Duration
+}
+
+// Allocator is a TURN relay: it hands out relayed UDP sockets to
+// authenticated clients and forwards data between them and their peers.
+type Allocator struct {
+	cfg    Config
+	auth   Authenticator
+	nonces NonceStore
+	realm  string
+
+	mu          sync.Mutex
+	byClient    map[string]*allocation
+	expiry      expiryHeap
+	nextPort    int
+	allocations int
+}
+
+// NewAllocator builds an Allocator, reusing auth/nonces/realm from the
+// STUN server's long-term credential setup since TURN mandates the same
+// authentication.
+func NewAllocator(cfg Config, auth Authenticator, nonces NonceStore, realm string) *Allocator {
+	if cfg.DefaultLifetime == 0 {
+		cfg.DefaultLifetime = 10 * time.Minute
+	}
+	a := &Allocator{
+		cfg:      cfg,
+		auth:     auth,
+		nonces:   nonces,
+		realm:    realm,
+		byClient: make(map[string]*allocation),
+		nextPort: cfg.MinPort,
+	}
+	go a.expiryLoop()
+	return a
+}
+
+// Handle answers a TURN request or indication from client, received on
+// conn, writing any response into res (left empty for indications that
+// need none, i.e. Send).
+func (a *Allocator) Handle(client net.Addr, conn net.PacketConn, req, res *stun.Message) error {
+	key, ok := a.authenticate(req)
+	if !ok && req.Type.Method != MethodSend {
+		return a.challenge(req, res)
+	}
+	switch req.Type.Method {
+	case MethodAllocate:
+		return a.handleAllocate(client, conn, req, res, key)
+	case MethodRefresh:
+		return a.handleRefresh(client, req, res, key)
+	case MethodCreatePermission:
+		return a.handleCreatePermission(client, req, res, key)
+	case MethodChannelBind:
+		return a.handleChannelBind(client, req, res, key)
+	case MethodSend:
+		return a.handleSend(client, req)
+	default:
+		return errors.Errorf("unsupported TURN method: %v", req.Type.Method)
+	}
+}
+
+// HandleChannelData relays a ChannelData message (not a STUN message) from
+// client to the peer bound to its channel number.
+func (a *Allocator) HandleChannelData(client net.Addr, b []byte) error {
+	if !IsChannelData(b) {
+		return errors.New("not a channeldata message")
+	}
+	number := uint16(b[0])<<8 | uint16(b[1])
+	length := int(uint16(b[2])<<8 | uint16(b[3]))
+	if len(b) < 4+length {
+		return errors.New("truncated channeldata message")
+	}
+	alloc, ok := a.get(client)
+	if !ok {
+		return errors.Errorf("no allocation for %s", client)
+	}
+	peer, ok := alloc.peerForChannel(number)
+	if !ok {
+		return errors.Errorf("unbound channel 0x%x", number)
+	}
+	_, err := alloc.relay.WriteTo(b[4:4+length], peer)
+	return err
+}
+
+func (a *Allocator) get(client net.Addr) (*allocation, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	alloc, ok := a.byClient[client.String()]
+	return alloc, ok
+}
+
+// Allocations returns the current number of active allocations, for
+// exposing as a metrics gauge.
+func (a *Allocator) Allocations() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.allocations
+}
+
+// Channels returns the current number of bound channels across all
+// allocations, for exposing as a metrics gauge.
+func (a *Allocator) Channels() int {
+	a.mu.Lock()
+	allocs := make([]*allocation, 0, len(a.byClient))
+	for _, alloc := range a.byClient {
+		allocs = append(allocs, alloc)
+	}
+	a.mu.Unlock()
+
+	n := 0
+	for _, alloc := range allocs {
+		alloc.mu.Lock()
+		n += len(alloc.channels)
+		alloc.mu.Unlock()
+	}
+	return n
+}
+
+func (a *Allocator) authenticate(req *stun.Message) (key []byte, ok bool) {
+	var (
+		username stun.Username
+		realm    stun.Realm
+		nonce    stun.Nonce
+	)
+	if username.GetFrom(req) != nil || realm.GetFrom(req) != nil || nonce.GetFrom(req) != nil {
+		return nil, false
+	}
+	if !a.nonces.Valid(string(nonce)) {
+		return nil, false
+	}
+	key, ok = a.auth.Lookup(string(username), string(realm))
+	if !ok {
+		return nil, false
+	}
+	integrity := stun.MessageIntegrity(key)
+	if integrity.Check(req) != nil {
+		return nil, false
+	}
+	return key, true
+}
+
+func (a *Allocator) challenge(req, res *stun.Message) error {
+	return res.Build(req,
+		stun.MessageType{Method: req.Type.Method, Class: stun.ClassErrorResponse},
+		&stun.ErrorCodeAttribute{Code: stun.CodeUnauthorized},
+		stun.NewRealm(a.realm),
+		stun.NewNonce(a.nonces.New()),
+		stun.Fingerprint,
+	)
+}
+
+func (a *Allocator) errorResponse(req, res *stun.Message, code stun.ErrorCode, reason string) error {
+	return res.Build(req,
+		stun.MessageType{Method: req.Type.Method, Class: stun.ClassErrorResponse},
+		&stun.ErrorCodeAttribute{Code: code, Reason: []byte(reason)},
+		stun.Fingerprint,
+	)
+}
+
+func (a *Allocator) handleAllocate(client net.Addr, conn net.PacketConn, req, res *stun.Message, key []byte) error {
+	if _, ok := a.get(client); ok {
+		return a.errorResponse(req, res, codeAllocationMismatch, "Allocation Mismatch")
+	}
+	if !requestedTransportOK(req) {
+		return a.errorResponse(req, res, codeForbidden, "Unsupported Transport")
+	}
+
+	relay, err := a.allocateRelay()
+	if err != nil {
+		return a.errorResponse(req, res, codeInsufficientCapacity, "Insufficient Capacity")
+	}
+
+	lifetime := a.cfg.DefaultLifetime
+	if l, ok := getLifetime(req); ok {
+		lifetime = time.Duration(l) * time.Second
+	}
+	alloc := newAllocation(client, conn, relay, lifetime)
+
+	a.mu.Lock()
+	if a.cfg.MaxAllocations > 0 && a.allocations >= a.cfg.MaxAllocations {
+		a.mu.Unlock()
+		relay.Close()
+		return a.errorResponse(req, res, codeInsufficientCapacity, "Max Allocations Reached")
+	}
+	a.byClient[client.String()] = alloc
+	heap.Push(&a.expiry, alloc)
+	a.allocations++
+	a.mu.Unlock()
+
+	go a.relayLoop(alloc)
+
+	relayAddr := relay.LocalAddr().(*net.UDPAddr)
+	clientIP, clientPort := clientAddr(client)
+	return res.Build(req,
+		stun.MessageType{Method: MethodAllocate, Class: stun.ClassSuccessResponse},
+		&stun.XORMappedAddress{IP: clientIP, Port: clientPort},
+		xorAddress{typ: attrXORRelayedAddress, ip: relayAddr.IP, port: relayAddr.Port},
+		lifetimeAttr(lifetime),
+		stun.MessageIntegrity(key),
+		stun.Fingerprint,
+	)
+}
+
+// clientAddr splits a TURN client's address into IP and port; TURN clients
+// always reach the allocator over UDP.
+func clientAddr(addr net.Addr) (net.IP, int) {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil, 0
+	}
+	return a.IP, a.Port
+}
+
+func lifetimeAttr(d time.Duration) lifetime {
+	return lifetime(d / time.Second)
+}
+
+func (a *Allocator) handleRefresh(client net.Addr, req, res *stun.Message, key []byte) error {
+	alloc, ok := a.get(client)
+	if !ok {
+		return a.errorResponse(req, res, codeAllocationMismatch, "Allocation Mismatch")
+	}
+	lifetime := a.cfg.DefaultLifetime
+	if l, ok := getLifetime(req); ok {
+		lifetime = time.Duration(l) * time.Second
+	}
+	if lifetime == 0 {
+		a.remove(alloc)
+	} else {
+		a.mu.Lock()
+		alloc.refresh(lifetime)
+		heap.Fix(&a.expiry, alloc.heapIndex)
+		a.mu.Unlock()
+	}
+	return res.Build(req,
+		stun.MessageType{Method: MethodRefresh, Class: stun.ClassSuccessResponse},
+		lifetimeAttr(lifetime),
+		stun.MessageIntegrity(key),
+		stun.Fingerprint,
+	)
+}
+
+func (a *Allocator) handleCreatePermission(client net.Addr, req, res *stun.Message, key []byte) error {
+	alloc, ok := a.get(client)
+	if !ok {
+		return a.errorResponse(req, res, codeAllocationMismatch, "Allocation Mismatch")
+	}
+	peerIP, _, ok := getXORAddress(req, attrXORPeerAddress)
+	if !ok {
+		return a.errorResponse(req, res, codeForbidden, "Missing XOR-PEER-ADDRESS")
+	}
+	alloc.permit(peerIP)
+	return res.Build(req,
+		stun.MessageType{Method: MethodCreatePermission, Class: stun.ClassSuccessResponse},
+		stun.MessageIntegrity(key),
+		stun.Fingerprint,
+	)
+}
+
+func (a *Allocator) handleChannelBind(client net.Addr, req, res *stun.Message, key []byte) error {
+	alloc, ok := a.get(client)
+	if !ok {
+		return a.errorResponse(req, res, codeAllocationMismatch, "Allocation Mismatch")
+	}
+	number, ok := getChannelNumber(req)
+	if !ok || number < minChannelNumber || number > maxChannelNumber {
+		return a.errorResponse(req, res, codeForbidden, "Invalid Channel Number")
+	}
+	peerIP, peerPort, ok := getXORAddress(req, attrXORPeerAddress)
+	if !ok {
+		return a.errorResponse(req, res, codeForbidden, "Missing XOR-PEER-ADDRESS")
+	}
+	alloc.bindChannel(number, &net.UDPAddr{IP: peerIP, Port: peerPort})
+	return res.Build(req,
+		stun.MessageType{Method: MethodChannelBind, Class: stun.ClassSuccessResponse},
+		stun.MessageIntegrity(key),
+		stun.Fingerprint,
+	)
+}
+
+// handleSend relays the DATA attribute of a Send indication to its
+// XOR-PEER-ADDRESS. Indications get no response, success or otherwise.
+func (a *Allocator) handleSend(client net.Addr, req *stun.Message) error {
+	alloc, ok := a.get(client)
+	if !ok {
+		return errors.Errorf("no allocation for %s", client)
+	}
+	peerIP, peerPort, ok := getXORAddress(req, attrXORPeerAddress)
+	if !ok {
+		return errors.New("missing XOR-PEER-ADDRESS")
+	}
+	if !alloc.permitted(peerIP) {
+		return errors.Errorf("no permission for peer %s", peerIP)
+	}
+	data, ok := getData(req)
+	if !ok {
+		return nil
+	}
+	_, err := alloc.relay.WriteTo(data, &net.UDPAddr{IP: peerIP, Port: peerPort})
+	return err
+}
+
+// relayLoop reads inbound traffic on alloc's relayed socket and forwards
+// it to the client as Data indications (or ChannelData, if a channel is
+// bound to that peer), until the relay is closed.
+func (a *Allocator) relayLoop(alloc *allocation) {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := alloc.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !alloc.permitted(addrIP(peer)) {
+			continue
+		}
+		if number, ok := alloc.channelForPeer(peer); ok {
+			a.sendChannelData(alloc, number, buf[:n])
+			continue
+		}
+		a.sendDataIndication(alloc, peer, buf[:n])
+	}
+}
+
+func (a *Allocator) sendDataIndication(alloc *allocation, peer net.Addr, payload []byte) {
+	peerAddr, ok := peer.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	msg := new(stun.Message)
+	err := msg.Build(
+		stun.MessageType{Method: MethodData, Class: stun.ClassIndication},
+		xorAddress{typ: attrXORPeerAddress, ip: peerAddr.IP, port: peerAddr.Port},
+		dataAttr(payload),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return
+	}
+	sendToClient(alloc, msg.Raw)
+}
+
+func (a *Allocator) sendChannelData(alloc *allocation, number uint16, payload []byte) {
+	frame := make([]byte, 4+len(payload))
+	frame[0] = byte(number >> 8)
+	frame[1] = byte(number)
+	frame[2] = byte(len(payload) >> 8)
+	frame[3] = byte(len(payload))
+	copy(frame[4:], payload)
+	sendToClient(alloc, frame)
+}
+
+// sendToClient writes a frame meant for alloc's client, using whatever
+// PacketConn the server used to reach it. The Allocate handler's caller
+// owns the server socket; relayed traffic is routed back through the same
+// one the client's original request arrived on.
+func sendToClient(alloc *allocation, b []byte) {
+	if alloc.clientConn == nil {
+		return
+	}
+	_, _ = alloc.clientConn.WriteTo(b, alloc.client)
+}
+
+// remove tears down alloc, closing its relay socket and decrementing the
+// allocation count. It is idempotent: a Refresh with LIFETIME 0 removes
+// the allocation immediately, so a later expiryLoop tick (or a
+// retransmitted Refresh-0) for the same allocation must be a no-op rather
+// than double-closing the relay or double-decrementing a.allocations.
+func (a *Allocator) remove(alloc *allocation) {
+	a.mu.Lock()
+	if a.byClient[alloc.client.String()] != alloc {
+		a.mu.Unlock()
+		return
+	}
+	delete(a.byClient, alloc.client.String())
+	if alloc.heapIndex >= 0 && alloc.heapIndex < len(a.expiry) && a.expiry[alloc.heapIndex] == alloc {
+		heap.Remove(&a.expiry, alloc.heapIndex)
+	}
+	a.allocations--
+	a.mu.Unlock()
+	alloc.relay.Close()
+}
+
+// expiryLoop closes allocations as their lifetimes run out, sleeping
+// until the next one is due rather than polling.
+func (a *Allocator) expiryLoop() {
+	for {
+		a.mu.Lock()
+		if len(a.expiry) == 0 {
+			a.mu.Unlock()
+			time.Sleep(time.Second)
+			continue
+		}
+		next := a.expiry[0]
+		wait := time.Until(next.expiresAt)
+		a.mu.Unlock()
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		if next.expired() {
+			a.remove(next)
+		}
+	}
+}
+
+// allocateRelay binds a relayed UDP socket in [MinPort, MaxPort],
+// cycling forward from the last port tried.
+func (a *Allocator) allocateRelay() (net.PacketConn, error) {
+	minPort := a.cfg.MinPort
+	if minPort == 0 {
+		minPort = 49152
+	}
+	maxPort := a.cfg.MaxPort
+	if maxPort == 0 {
+		maxPort = 65535
+	}
+	a.mu.Lock()
+	start := a.nextPort
+	a.mu.Unlock()
+	if start < minPort || start > maxPort {
+		start = minPort
+	}
+	span := maxPort - minPort + 1
+	if span <= 0 {
+		span = 1
+	}
+	for i := 0; i < span; i++ {
+		port := start + i
+		if port > maxPort {
+			port = minPort + (port - maxPort - 1)
+		}
+		conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			a.mu.Lock()
+			a.nextPort = port + 1
+			a.mu.Unlock()
+			return conn, nil
+		}
+	}
+	return nil, errors.New("no free relay port")
+}